@@ -0,0 +1,188 @@
+package astmapper
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+)
+
+// federationSummer expands a query AST to fan out across a fixed set of clusters (or tenants),
+// reusing shardSummer's leg-splitting machinery but pinning each leg to a cluster rather than a
+// shard of the hash space.
+type federationSummer struct {
+	splitLabel string
+	clusters   []string
+	currentLeg *legDescriptor
+	squash     squasher
+	analyzer   *QueryAnalyzer
+
+	// canShardAllVectorSelectorsCache remembers, by query string, whether every vector/matrix
+	// selector in that query is already pinned to a specific splitLabel value -- in which case
+	// the query has already been through federation (e.g. as part of a subquery this mapper
+	// visits more than once) and shouldn't be split again. It's a pointer so that it's shared
+	// (not copied) across the clones CopyWithCurLeg makes for each leg.
+	canShardAllVectorSelectorsCache *sync.Map
+
+	// Metrics.
+	federatedQueries prometheus.Counter
+}
+
+// NewFederationSummer instantiates an ASTMapper which fans out sum queries across clusters,
+// constraining each leg to one cluster via an equality matcher on splitLabel and having the
+// parent aggregate by splitLabel so that results from different clusters are unioned rather
+// than summed together.
+func NewFederationSummer(splitLabel string, clusters []string, squasher squasher, registerer prometheus.Registerer) (ASTMapper, error) {
+	if squasher == nil {
+		return nil, errors.Errorf("squasher required and not passed")
+	}
+
+	analyzer, err := NewQueryAnalyzer(registerer)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewASTNodeMapper(&federationSummer{
+		splitLabel:                      splitLabel,
+		clusters:                        clusters,
+		squash:                          squasher,
+		analyzer:                        analyzer,
+		canShardAllVectorSelectorsCache: &sync.Map{},
+		federatedQueries: promauto.With(registerer).NewCounter(prometheus.CounterOpts{
+			Namespace: "cortex",
+			Name:      "frontend_federated_queries_total",
+			Help:      "Total number of federated queries",
+		}),
+	}), nil
+}
+
+// CopyWithCurLeg clones a federationSummer with a new current leg.
+func (summer *federationSummer) CopyWithCurLeg(leg legDescriptor) *federationSummer {
+	s := *summer
+	s.currentLeg = &leg
+	return &s
+}
+
+func (summer *federationSummer) MapNode(node promql.Node) (promql.Node, bool, error) {
+	switch n := node.(type) {
+	case *promql.AggregateExpr:
+		// See shardSummer.MapNode: canFederate (via canShardByGrouping), not CanParallelize,
+		// gates federation here so label_replace/label_join stay federatable. This shares
+		// nonShardableFuncs with shardSummer, so it's more conservative than strictly
+		// necessary for functions like histogram_quantile that are only unsafe under hash
+		// sharding -- federation splits on a real label value, not a hash, so bucket-style
+		// aggregations would actually be safe to federate; that's left as a future
+		// improvement rather than special-cased here.
+		if n.Op == promql.SUM && summer.canFederate(n) {
+			result, err := summer.federateSum(n)
+			return result, true, err
+		}
+
+		return n, false, nil
+
+	case *promql.VectorSelector:
+		if summer.currentLeg != nil {
+			mapped, err := pinVectorSelector(*summer.currentLeg, n)
+			return mapped, true, err
+		}
+		return n, true, nil
+
+	case *promql.MatrixSelector:
+		if summer.currentLeg != nil {
+			mapped, err := pinMatrixSelector(*summer.currentLeg, n)
+			return mapped, true, err
+		}
+		return n, true, nil
+
+	default:
+		return n, false, nil
+	}
+}
+
+// canFederate reports whether expr may be split across clusters: it must pass the usual
+// shardability analysis, and must not already have every one of its vector/matrix selectors
+// pinned to a single splitLabel value (which would mean it's already been federated).
+func (summer *federationSummer) canFederate(expr *promql.AggregateExpr) bool {
+	if !canShardByGrouping(summer.analyzer, expr) {
+		return false
+	}
+
+	return !summer.allVectorSelectorsPinned(expr.String(), expr)
+}
+
+// allVectorSelectorsPinned reports whether every vector/matrix selector within expr already
+// carries an equality matcher on splitLabel, memoizing the result by key (expr's string form).
+func (summer *federationSummer) allVectorSelectorsPinned(key string, expr *promql.AggregateExpr) bool {
+	if cached, ok := summer.canShardAllVectorSelectorsCache.Load(key); ok {
+		return cached.(bool)
+	}
+
+	pinned := true
+	promql.Inspect(expr, func(n promql.Node, _ []promql.Node) error {
+		var matchers []*labels.Matcher
+		switch sel := n.(type) {
+		case *promql.VectorSelector:
+			matchers = sel.LabelMatchers
+		case *promql.MatrixSelector:
+			if vs, ok := sel.VectorSelector.(*promql.VectorSelector); ok {
+				matchers = vs.LabelMatchers
+			}
+		default:
+			return nil
+		}
+
+		if !hasEqualityMatcher(matchers, summer.splitLabel) {
+			pinned = false
+		}
+		return nil
+	})
+
+	summer.canShardAllVectorSelectorsCache.Store(key, pinned)
+	return pinned
+}
+
+// hasEqualityMatcher reports whether matchers contains an equality matcher on name.
+func hasEqualityMatcher(matchers []*labels.Matcher, name string) bool {
+	for _, m := range matchers {
+		if m.Name == name && m.Type == labels.MatchEqual {
+			return true
+		}
+	}
+	return false
+}
+
+// federateSum splits expr into one leg per cluster and squashes them back together.
+func (summer *federationSummer) federateSum(expr *promql.AggregateExpr) (promql.Node, error) {
+	legs := make([]legDescriptor, 0, len(summer.clusters))
+	for _, cluster := range summer.clusters {
+		legs = append(legs, legDescriptor{
+			label: summer.splitLabel,
+			value: cluster,
+		})
+	}
+
+	parent, children, err := splitLegs(expr, summer.splitLabel, legs, keepLegLabel, summer.mapLeg)
+	if err != nil {
+		return nil, err
+	}
+
+	combined, err := summer.squash(children...)
+	if err != nil {
+		return nil, err
+	}
+
+	summer.federatedQueries.Add(float64(len(summer.clusters)))
+
+	parent.Expr = combined
+	return parent, nil
+}
+
+// mapLeg clones node under a federationSummer pinned to leg's cluster, rewriting its
+// vector/matrix selectors to only match that cluster's data.
+func (summer *federationSummer) mapLeg(leg legDescriptor, node promql.Node) (promql.Node, error) {
+	subSummer := NewASTNodeMapper(summer.CopyWithCurLeg(leg))
+	return subSummer.Map(node)
+}
@@ -0,0 +1,153 @@
+package astmapper
+
+import (
+	"fmt"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+)
+
+// legDescriptor pins a single leg (fan-out branch) of a parallelized aggregation to an
+// equality matcher on a specific label. It's the shared building block behind both shard
+// fan-out (label __cortex_shard__, value "0_of_4") and cross-cluster federation (label
+// "cluster", value "us-east").
+type legDescriptor struct {
+	label string
+	value string
+}
+
+func (l legDescriptor) matcher() (*labels.Matcher, error) {
+	return labels.NewMatcher(labels.MatchEqual, l.label, l.value)
+}
+
+// legGrouping controls whether the leg label survives into the parent AggregateExpr's result
+// once the legs have been squashed back together.
+type legGrouping int
+
+const (
+	// dropLegLabel hides the leg label from the parent's grouping: the label is a synthetic
+	// implementation detail of the fan-out and shouldn't leak into the result. Used by
+	// shardSummer, where __cortex_shard__ is an artificial hash-space partition.
+	dropLegLabel legGrouping = iota
+	// keepLegLabel adds the leg label to the parent's grouping: each leg is a semantically
+	// meaningful partition of the data whose identity should survive so legs are unioned
+	// rather than summed together. Used by the federation summer, where the leg label (e.g.
+	// cluster) is a real label on the underlying series.
+	keepLegLabel
+)
+
+// splitLegs forms the parent and per-leg children of a parallelized aggregation. legLabel is
+// the label distinguishing legs, legs enumerates the value each leg is pinned to, grouping
+// controls whether legLabel survives into the parent's grouping, and mapLeg rewrites a cloned
+// copy of expr.Expr to apply a single leg's matcher to its vector/matrix selectors.
+func splitLegs(
+	expr *promql.AggregateExpr,
+	legLabel string,
+	legs []legDescriptor,
+	grouping legGrouping,
+	mapLeg func(legDescriptor, promql.Node) (promql.Node, error),
+) (parent *promql.AggregateExpr, children []promql.Node, err error) {
+	parent = &promql.AggregateExpr{
+		Op:    expr.Op,
+		Param: expr.Param,
+	}
+	var mkChild func(leg *promql.AggregateExpr) promql.Expr
+
+	switch {
+	case expr.Without:
+		// without(foo) already retains legLabel in its result for free, so only dropLegLabel
+		// needs extra handling: an outer without(legLabel) to discard the synthetic dimension
+		// once the legs have been recombined.
+		parent.Without = true
+		if grouping == dropLegLabel {
+			parent.Grouping = []string{legLabel}
+		} else {
+			parent.Grouping = expr.Grouping
+		}
+		mkChild = func(leg *promql.AggregateExpr) promql.Expr {
+			leg.Grouping = expr.Grouping
+			leg.Without = true
+			return leg
+		}
+
+	case len(expr.Grouping) > 0:
+		parent.Grouping = expr.Grouping
+		childGroups := append(append([]string{}, expr.Grouping...), legLabel)
+		if grouping == keepLegLabel {
+			parent.Grouping = childGroups
+		}
+		mkChild = func(leg *promql.AggregateExpr) promql.Expr {
+			leg.Grouping = childGroups
+			return leg
+		}
+
+	default:
+		parent.Grouping = []string{legLabel}
+		parent.Without = grouping == dropLegLabel
+		mkChild = func(leg *promql.AggregateExpr) promql.Expr {
+			leg.Grouping = []string{legLabel}
+			return leg
+		}
+	}
+
+	for _, leg := range legs {
+		cloned, err := CloneNode(expr.Expr)
+		if err != nil {
+			return parent, children, err
+		}
+
+		mapped, err := mapLeg(leg, cloned)
+		if err != nil {
+			return parent, children, err
+		}
+
+		children = append(children, mkChild(&promql.AggregateExpr{
+			Op:   expr.Op,
+			Expr: mapped.(promql.Expr),
+		}))
+	}
+
+	return parent, children, nil
+}
+
+func pinVectorSelector(leg legDescriptor, selector *promql.VectorSelector) (promql.Node, error) {
+	matcher, err := leg.matcher()
+	if err != nil {
+		return nil, err
+	}
+
+	return &promql.VectorSelector{
+		Name:   selector.Name,
+		Offset: selector.Offset,
+		LabelMatchers: append(
+			[]*labels.Matcher{matcher},
+			selector.LabelMatchers...,
+		),
+	}, nil
+}
+
+func pinMatrixSelector(leg legDescriptor, selector *promql.MatrixSelector) (promql.Node, error) {
+	matcher, err := leg.matcher()
+	if err != nil {
+		return nil, err
+	}
+
+	vs, ok := selector.VectorSelector.(*promql.VectorSelector)
+	if !ok {
+		return nil, fmt.Errorf("invalid selector type: %T", selector.VectorSelector)
+	}
+
+	return &promql.MatrixSelector{
+		VectorSelector: &promql.VectorSelector{
+			Name:   vs.Name,
+			Offset: vs.Offset,
+			LabelMatchers: append(
+				[]*labels.Matcher{matcher},
+				vs.LabelMatchers...,
+			),
+			PosRange: vs.PosRange,
+		},
+		Range:  selector.Range,
+		EndPos: selector.EndPos,
+	}, nil
+}
@@ -0,0 +1,162 @@
+package astmapper
+
+import (
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/promql"
+)
+
+// defaultAnalysisCacheSize bounds the number of distinct query strings whose shardability
+// analysis is cached by a QueryAnalyzer.
+const defaultAnalysisCacheSize = 1024
+
+// nonShardableFuncs is a denylist of PromQL functions whose results depend on seeing the
+// entire, unsharded input vector/matrix. An aggregation calling one of these anywhere within
+// its own AST is not sharded; a call that encloses the aggregation is not part of its analysis
+// and does not stop it from being sharded. histogram_quantile and quantile_over_time are here because hash
+// sharding (shardSummer, as opposed to federationSummer's real-label split) partitions series
+// by __cortex_shard__, which splits a single metric's `le`/quantile buckets across shards, so
+// computing a quantile per shard operates on incomplete buckets and produces the wrong answer.
+var nonShardableFuncs = map[string]struct{}{
+	"absent":             {},
+	"absent_over_time":   {},
+	"histogram_quantile": {},
+	"quantile_over_time": {},
+	"scalar":             {},
+	"sort":               {},
+	"sort_desc":          {},
+}
+
+// QueryAnalysis is the result of walking a query's AST to determine whether (and how) it may
+// be sharded.
+type QueryAnalysis struct {
+	shardable bool
+
+	// unsafeLabels are labels which must not appear in an enclosing aggregation's grouping
+	// clause, because sharding would change which samples land in which group. This is
+	// populated from the destination label of label_replace/label_join calls.
+	unsafeLabels map[string]struct{}
+}
+
+// IsShardable reports whether the analyzed query may be sharded at all.
+func (a QueryAnalysis) IsShardable() bool {
+	return a.shardable
+}
+
+func nonShardableAnalysis() QueryAnalysis {
+	return QueryAnalysis{shardable: false}
+}
+
+func shardableAnalysis(unsafeLabels map[string]struct{}) QueryAnalysis {
+	return QueryAnalysis{shardable: true, unsafeLabels: unsafeLabels}
+}
+
+// QueryAnalyzer inspects a promql.Node to determine whether it is safe to shard, replacing a
+// single CanParallelize bool check with a structured analysis that also tracks which grouping
+// labels are unsafe to shard by (e.g. the destination label of label_replace/label_join).
+// Analyses are cached by query string so that repeated queries in the query-frontend hot path
+// don't re-walk the AST.
+type QueryAnalyzer struct {
+	cache *lru.Cache
+
+	cacheHits   prometheus.Counter
+	cacheMisses prometheus.Counter
+}
+
+// NewQueryAnalyzer instantiates a QueryAnalyzer backed by a fixed-size LRU cache.
+func NewQueryAnalyzer(registerer prometheus.Registerer) (*QueryAnalyzer, error) {
+	cache, err := lru.New(defaultAnalysisCacheSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &QueryAnalyzer{
+		cache: cache,
+		cacheHits: promauto.With(registerer).NewCounter(prometheus.CounterOpts{
+			Namespace: "cortex",
+			Name:      "frontend_query_analysis_cache_hits_total",
+			Help:      "Total number of query shardability analyses served from cache",
+		}),
+		cacheMisses: promauto.With(registerer).NewCounter(prometheus.CounterOpts{
+			Namespace: "cortex",
+			Name:      "frontend_query_analysis_cache_misses_total",
+			Help:      "Total number of query shardability analyses computed from scratch",
+		}),
+	}, nil
+}
+
+// Analyze returns the QueryAnalysis for node, which was parsed from query. query is used only
+// as the cache key.
+func (a *QueryAnalyzer) Analyze(query string, node promql.Node) QueryAnalysis {
+	if cached, ok := a.cache.Get(query); ok {
+		a.cacheHits.Inc()
+		return cached.(QueryAnalysis)
+	}
+
+	a.cacheMisses.Inc()
+	analysis := analyze(node)
+	a.cache.Add(query, analysis)
+	return analysis
+}
+
+// analyze walks node looking for calls to denylisted, non-shardable functions. label_replace
+// and label_join are special-cased: rather than forbidding sharding outright, the destination
+// label they write is recorded as unsafe to group by. promql.Inspect doesn't surface a result
+// (it discards Walk's error, same contract as go/ast.Inspect), so shardability is tracked via a
+// closure flag instead.
+func analyze(node promql.Node) QueryAnalysis {
+	unsafeLabels := map[string]struct{}{}
+	shardable := true
+
+	promql.Inspect(node, func(n promql.Node, _ []promql.Node) error {
+		call, ok := n.(*promql.Call)
+		if !ok {
+			return nil
+		}
+
+		switch call.Func.Name {
+		case "label_replace":
+			if dst, ok := callStringArg(call, 1); ok {
+				unsafeLabels[dst] = struct{}{}
+			}
+		case "label_join":
+			if dst, ok := callStringArg(call, 1); ok {
+				unsafeLabels[dst] = struct{}{}
+			}
+		default:
+			if _, denied := nonShardableFuncs[call.Func.Name]; denied {
+				shardable = false
+			}
+		}
+
+		return nil
+	})
+
+	if !shardable {
+		return nonShardableAnalysis()
+	}
+	return shardableAnalysis(unsafeLabels)
+}
+
+// canShardByGrouping reports whether expr is shardable according to analyzer, consulting
+// ShardableGrouping for the label_replace/label_join destination-label safety rules. It's
+// shared by shardSummer and federationSummer, which otherwise differ only in how they fan out
+// and recombine legs.
+func canShardByGrouping(analyzer *QueryAnalyzer, expr *promql.AggregateExpr) bool {
+	analysis := analyzer.Analyze(expr.String(), expr)
+	_, ok := ShardableGrouping(expr, analysis)
+	return ok
+}
+
+// callStringArg returns the string literal value of call's argument at idx, if present.
+func callStringArg(call *promql.Call, idx int) (string, bool) {
+	if idx >= len(call.Args) {
+		return "", false
+	}
+	lit, ok := call.Args[idx].(*promql.StringLiteral)
+	if !ok {
+		return "", false
+	}
+	return lit.Val, true
+}
@@ -28,9 +28,10 @@ var (
 type squasher = func(...promql.Node) (promql.Expr, error)
 
 type shardSummer struct {
-	shards       int
-	currentShard *int
-	squash       squasher
+	shards     int
+	currentLeg *legDescriptor
+	squash     squasher
+	analyzer   *QueryAnalyzer
 
 	// Metrics.
 	shardedQueries prometheus.Counter
@@ -42,10 +43,16 @@ func NewShardSummer(shards int, squasher squasher, registerer prometheus.Registe
 		return nil, errors.Errorf("squasher required and not passed")
 	}
 
+	analyzer, err := NewQueryAnalyzer(registerer)
+	if err != nil {
+		return nil, err
+	}
+
 	return NewASTNodeMapper(&shardSummer{
-		shards:       shards,
-		squash:       squasher,
-		currentShard: nil,
+		shards:     shards,
+		squash:     squasher,
+		currentLeg: nil,
+		analyzer:   analyzer,
 		shardedQueries: promauto.With(registerer).NewCounter(prometheus.CounterOpts{
 			Namespace: "cortex",
 			Name:      "frontend_sharded_queries_total",
@@ -54,10 +61,10 @@ func NewShardSummer(shards int, squasher squasher, registerer prometheus.Registe
 	}), nil
 }
 
-// CopyWithCurShard clones a shardSummer with a new current shard.
-func (summer *shardSummer) CopyWithCurShard(curshard int) *shardSummer {
+// CopyWithCurLeg clones a shardSummer with a new current leg.
+func (summer *shardSummer) CopyWithCurLeg(leg legDescriptor) *shardSummer {
 	s := *summer
-	s.currentShard = &curshard
+	s.currentLeg = &leg
 	return &s
 }
 
@@ -66,7 +73,14 @@ func (summer *shardSummer) MapNode(node promql.Node) (promql.Node, bool, error)
 
 	switch n := node.(type) {
 	case *promql.AggregateExpr:
-		if CanParallelize(n) && n.Op == promql.SUM {
+		// canShardByGrouping, not CanParallelize, gates sharding here: CanParallelize's own
+		// denylist rejects label_replace/label_join outright, which would make the
+		// destination-label check below unreachable. nonShardableFuncs (query_analysis.go)
+		// instead denylists, by name, the specific functions known to break under hash
+		// sharding -- it is a targeted list, not a verified superset of everything
+		// CanParallelize used to reject, so revisit it if other CanParallelize-only rejections
+		// turn out to matter for correctness here too.
+		if n.Op == promql.SUM && canShardByGrouping(summer.analyzer, n) {
 			result, err := summer.shardSum(n)
 			return result, true, err
 		}
@@ -74,15 +88,15 @@ func (summer *shardSummer) MapNode(node promql.Node) (promql.Node, bool, error)
 		return n, false, nil
 
 	case *promql.VectorSelector:
-		if summer.currentShard != nil {
-			mapped, err := shardVectorSelector(*summer.currentShard, summer.shards, n)
+		if summer.currentLeg != nil {
+			mapped, err := pinVectorSelector(*summer.currentLeg, n)
 			return mapped, true, err
 		}
 		return n, true, nil
 
 	case *promql.MatrixSelector:
-		if summer.currentShard != nil {
-			mapped, err := shardMatrixSelector(*summer.currentShard, summer.shards, n)
+		if summer.currentLeg != nil {
+			mapped, err := pinMatrixSelector(*summer.currentLeg, n)
 			return mapped, true, err
 		}
 		return n, true, nil
@@ -110,7 +124,10 @@ func (summer *shardSummer) shardSum(expr *promql.AggregateExpr) (promql.Node, er
 	return parent, nil
 }
 
-// splitSum forms the parent and child legs of a parallel query
+// splitSum forms the parent and child legs of a parallel query. It shares its leg-splitting
+// logic with the federation summer via splitLegs, pinning each leg to one shard of
+// ShardLabel and dropping that label from the parent's result once the legs are recombined,
+// since it's a synthetic hash-space partition rather than a real label on the data.
 func (summer *shardSummer) splitSum(
 	expr *promql.AggregateExpr,
 ) (
@@ -118,91 +135,17 @@ func (summer *shardSummer) splitSum(
 	children []promql.Node,
 	err error,
 ) {
-	parent = &promql.AggregateExpr{
-		Op:    expr.Op,
-		Param: expr.Param,
-	}
-	var mkChild func(sharded *promql.AggregateExpr) promql.Expr
-
-	if expr.Without {
-		/*
-			parallelizing a sum using without(foo) is representable naively as
-			sum without(foo) (
-			  sum without(__cortex_shard__) (rate(bar1{__cortex_shard__="0_of_2",baz="blip"}[1m])) or
-			  sum without(__cortex_shard__) (rate(bar1{__cortex_shard__="1_of_2",baz="blip"}[1m]))
-			)
-			or (more optimized):
-			sum without(__cortex_shard__) (
-			  sum without(foo) (rate(bar1{__cortex_shard__="0_of_2",baz="blip"}[1m])) or
-			  sum without(foo) (rate(bar1{__cortex_shard__="1_of_2",baz="blip"}[1m]))
-			)
-
-		*/
-		parent.Grouping = []string{ShardLabel}
-		parent.Without = true
-		mkChild = func(sharded *promql.AggregateExpr) promql.Expr {
-			sharded.Grouping = expr.Grouping
-			sharded.Without = true
-			return sharded
-		}
-	} else if len(expr.Grouping) > 0 {
-		/*
-			parallelizing a sum using by(foo) is representable as
-			sum by(foo) (
-			  sum by(foo, __cortex_shard__) (rate(bar1{__cortex_shard__="0_of_2",baz="blip"}[1m])) or
-			  sum by(foo, __cortex_shard__) (rate(bar1{__cortex_shard__="1_of_2",baz="blip"}[1m]))
-			)
-		*/
-		parent.Grouping = expr.Grouping
-		mkChild = func(sharded *promql.AggregateExpr) promql.Expr {
-			groups := make([]string, 0, len(expr.Grouping)+1)
-			groups = append(groups, expr.Grouping...)
-			groups = append(groups, ShardLabel)
-			sharded.Grouping = groups
-			return sharded
-		}
-	} else {
-		/*
-			parallelizing a non-parameterized sum is representable as
-			sum(
-			  sum without(__cortex_shard__) (rate(bar1{__cortex_shard__="0_of_2",baz="blip"}[1m])) or
-			  sum without(__cortex_shard__) (rate(bar1{__cortex_shard__="1_of_2",baz="blip"}[1m]))
-			)
-			or (more optimized):
-			sum without(__cortex_shard__) (
-			  sum by(__cortex_shard__) (rate(bar1{__cortex_shard__="0_of_2",baz="blip"}[1m])) or
-			  sum by(__cortex_shard__) (rate(bar1{__cortex_shard__="1_of_2",baz="blip"}[1m]))
-			)
-		*/
-		parent.Grouping = []string{ShardLabel}
-		parent.Without = true
-		mkChild = func(sharded *promql.AggregateExpr) promql.Expr {
-			sharded.Grouping = []string{ShardLabel}
-			return sharded
-		}
-	}
-
-	// iterate across shardFactor to create children
+	legs := make([]legDescriptor, 0, summer.shards)
 	for i := 0; i < summer.shards; i++ {
-		cloned, err := CloneNode(expr.Expr)
-		if err != nil {
-			return parent, children, err
-		}
-
-		subSummer := NewASTNodeMapper(summer.CopyWithCurShard(i))
-		sharded, err := subSummer.Map(cloned)
-		if err != nil {
-			return parent, children, err
-		}
-
-		subSum := mkChild(&promql.AggregateExpr{
-			Op:   expr.Op,
-			Expr: sharded.(promql.Expr),
+		legs = append(legs, legDescriptor{
+			label: ShardLabel,
+			value: fmt.Sprintf(ShardLabelFmt, i, summer.shards),
 		})
+	}
 
-		children = append(children,
-			subSum,
-		)
+	parent, children, err = splitLegs(expr, ShardLabel, legs, dropLegLabel, summer.mapLeg)
+	if err != nil {
+		return parent, children, err
 	}
 
 	summer.shardedQueries.Add(float64(summer.shards))
@@ -210,45 +153,11 @@ func (summer *shardSummer) splitSum(
 	return parent, children, nil
 }
 
-func shardVectorSelector(curshard, shards int, selector *promql.VectorSelector) (promql.Node, error) {
-	shardMatcher, err := labels.NewMatcher(labels.MatchEqual, ShardLabel, fmt.Sprintf(ShardLabelFmt, curshard, shards))
-	if err != nil {
-		return nil, err
-	}
-
-	return &promql.VectorSelector{
-		Name:   selector.Name,
-		Offset: selector.Offset,
-		LabelMatchers: append(
-			[]*labels.Matcher{shardMatcher},
-			selector.LabelMatchers...,
-		),
-	}, nil
-}
-
-func shardMatrixSelector(curshard, shards int, selector *promql.MatrixSelector) (promql.Node, error) {
-	shardMatcher, err := labels.NewMatcher(labels.MatchEqual, ShardLabel, fmt.Sprintf(ShardLabelFmt, curshard, shards))
-	if err != nil {
-		return nil, err
-	}
-
-	if vs, ok := selector.VectorSelector.(*promql.VectorSelector); ok {
-		return &promql.MatrixSelector{
-			VectorSelector: &promql.VectorSelector{
-				Name:   vs.Name,
-				Offset: vs.Offset,
-				LabelMatchers: append(
-					[]*labels.Matcher{shardMatcher},
-					vs.LabelMatchers...,
-				),
-				PosRange: vs.PosRange,
-			},
-			Range:  selector.Range,
-			EndPos: selector.EndPos,
-		}, nil
-	}
-
-	return nil, fmt.Errorf("invalid selector type: %T", selector.VectorSelector)
+// mapLeg clones node under a shardSummer pinned to leg's shard, rewriting its vector/matrix
+// selectors to only match that shard's data.
+func (summer *shardSummer) mapLeg(leg legDescriptor, node promql.Node) (promql.Node, error) {
+	subSummer := NewASTNodeMapper(summer.CopyWithCurLeg(leg))
+	return subSummer.Map(node)
 }
 
 // ParseShard will extract the shard information encoded in ShardLabelFmt
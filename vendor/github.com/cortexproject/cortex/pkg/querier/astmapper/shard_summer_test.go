@@ -0,0 +1,106 @@
+package astmapper
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/promql"
+	"github.com/stretchr/testify/require"
+)
+
+// orSquasher combines legs with the binary `or` operator, mirroring how the query-frontend
+// recombines sharded/federated legs before executing them.
+func orSquasher(nodes ...promql.Node) (promql.Expr, error) {
+	result := nodes[0].(promql.Expr)
+	for _, n := range nodes[1:] {
+		result = &promql.BinaryExpr{
+			Op:             promql.LOR,
+			LHS:            result,
+			RHS:            n.(promql.Expr),
+			VectorMatching: &promql.VectorMatching{Card: promql.CardManyToMany},
+		}
+	}
+	return result, nil
+}
+
+// TestShardSummer_LabelReplace drives NewShardSummer/MapNode end-to-end for a query containing
+// label_replace, exercising both the chunk0-1 QueryAnalyzer wiring and the chunk0-3
+// ShardableGrouping destination-label check together, rather than just ShardableGrouping in
+// isolation.
+func TestShardSummer_LabelReplace(t *testing.T) {
+	mapper, err := NewShardSummer(2, orSquasher, nil)
+	require.NoError(t, err)
+
+	expr, err := promql.ParseExpr(`sum by(foo) (label_replace(rate(x[1m]), "bar", "$1", "baz", "(.*)"))`)
+	require.NoError(t, err)
+
+	mapped, err := mapper.Map(expr)
+	require.NoError(t, err)
+
+	parent, ok := mapped.(*promql.AggregateExpr)
+	require.True(t, ok, "expected a sharded AggregateExpr, got %T", mapped)
+	require.Equal(t, []string{"foo"}, parent.Grouping)
+
+	or, ok := parent.Expr.(*promql.BinaryExpr)
+	require.True(t, ok, "expected legs to be combined with a binary expr, got %T", parent.Expr)
+
+	for _, legExpr := range []promql.Expr{or.LHS, or.RHS} {
+		leg, ok := legExpr.(*promql.AggregateExpr)
+		require.True(t, ok, "expected a leg AggregateExpr, got %T", legExpr)
+		require.ElementsMatch(t, []string{"foo", ShardLabel}, leg.Grouping)
+		require.True(t, legPinnedToAShard(t, leg), "leg vector selector missing %s matcher", ShardLabel)
+	}
+}
+
+// legPinnedToAShard reports whether leg's vector selector carries an equality matcher on
+// ShardLabel.
+func legPinnedToAShard(t *testing.T, leg *promql.AggregateExpr) bool {
+	t.Helper()
+
+	labelReplace, ok := leg.Expr.(*promql.Call)
+	require.True(t, ok, "expected label_replace(...) call, got %T", leg.Expr)
+	require.Len(t, labelReplace.Args, 5)
+
+	call, ok := labelReplace.Args[0].(*promql.Call)
+	require.True(t, ok, "expected rate(...) call, got %T", labelReplace.Args[0])
+	require.Len(t, call.Args, 1)
+
+	matrix, ok := call.Args[0].(*promql.MatrixSelector)
+	require.True(t, ok, "expected matrix selector, got %T", call.Args[0])
+
+	vector, ok := matrix.VectorSelector.(*promql.VectorSelector)
+	require.True(t, ok, "expected vector selector, got %T", matrix.VectorSelector)
+
+	return hasEqualityMatcher(vector.LabelMatchers, ShardLabel)
+}
+
+// TestShardSummer_LabelReplaceUnsafeGrouping asserts that grouping by label_replace's
+// destination label prevents sharding, leaving the query untouched.
+func TestShardSummer_LabelReplaceUnsafeGrouping(t *testing.T) {
+	mapper, err := NewShardSummer(2, orSquasher, nil)
+	require.NoError(t, err)
+
+	query := `sum by(bar) (label_replace(rate(x[1m]), "bar", "$1", "baz", "(.*)"))`
+	expr, err := promql.ParseExpr(query)
+	require.NoError(t, err)
+
+	mapped, err := mapper.Map(expr)
+	require.NoError(t, err)
+	require.Equal(t, query, mapped.String())
+}
+
+// TestShardSummer_HistogramQuantileNotSharded asserts that a sum over histogram_quantile is
+// never hash sharded: doing so would split a metric's `le` buckets across shards, so each shard
+// would compute the quantile over an incomplete set of buckets.
+func TestShardSummer_HistogramQuantileNotSharded(t *testing.T) {
+	mapper, err := NewShardSummer(2, orSquasher, nil)
+	require.NoError(t, err)
+
+	quantile := `histogram_quantile(0.9, rate(x_bucket[1m]))`
+	full := `sum by(job) (` + quantile + `)`
+	expr, err := promql.ParseExpr(full)
+	require.NoError(t, err)
+
+	mapped, err := mapper.Map(expr)
+	require.NoError(t, err)
+	require.Equal(t, full, mapped.String(), "sum by(job) over histogram_quantile must not be sharded")
+}
@@ -0,0 +1,45 @@
+package astmapper
+
+import "github.com/prometheus/prometheus/promql"
+
+// ShardableGrouping determines whether expr may be sharded given analysis, taking into account
+// the destination labels of any nested label_replace/label_join calls recorded there. A query
+// containing label_replace(..., "dst", ...) can still be sharded as long as "dst" isn't one of
+// the labels that would actually change which shard a sample lands in:
+//
+//   - sum by(labels...): sharding by "labels" is safe as long as none of them is a destination
+//     label, i.e. labels ∩ destinations == ∅.
+//   - sum without(labels...): "labels" are excluded from the grouping key, so sharding is safe
+//     only if every destination label is excluded too, i.e. destinations ⊆ labels.
+//
+// On success it returns expr's own grouping labels unchanged, for convenience at call sites.
+func ShardableGrouping(expr *promql.AggregateExpr, analysis QueryAnalysis) (grouping []string, ok bool) {
+	if !analysis.IsShardable() {
+		return nil, false
+	}
+
+	if expr.Without {
+		for dst := range analysis.unsafeLabels {
+			if !containsLabel(expr.Grouping, dst) {
+				return nil, false
+			}
+		}
+		return expr.Grouping, true
+	}
+
+	for _, lbl := range expr.Grouping {
+		if _, unsafe := analysis.unsafeLabels[lbl]; unsafe {
+			return nil, false
+		}
+	}
+	return expr.Grouping, true
+}
+
+func containsLabel(labels []string, lbl string) bool {
+	for _, l := range labels {
+		if l == lbl {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package astmapper
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/promql"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardableGrouping(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		query    string
+		expectOK bool
+	}{
+		{
+			name:     "by grouping excludes label_replace destination",
+			query:    `sum by(foo) (label_replace(rate(x[1m]), "bar", "$1", "baz", "(.*)"))`,
+			expectOK: true,
+		},
+		{
+			name:     "by grouping includes label_replace destination",
+			query:    `sum by(bar) (label_replace(rate(x[1m]), "bar", "$1", "baz", "(.*)"))`,
+			expectOK: false,
+		},
+		{
+			name:     "without grouping excludes label_replace destination",
+			query:    `sum without(bar) (label_replace(rate(x[1m]), "bar", "$1", "baz", "(.*)"))`,
+			expectOK: true,
+		},
+		{
+			name:     "without grouping keeps label_replace destination",
+			query:    `sum without(foo) (label_replace(rate(x[1m]), "bar", "$1", "baz", "(.*)"))`,
+			expectOK: false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			expr, err := promql.ParseExpr(tc.query)
+			require.NoError(t, err)
+
+			agg, ok := expr.(*promql.AggregateExpr)
+			require.True(t, ok)
+
+			analysis := analyze(agg)
+			_, ok = ShardableGrouping(agg, analysis)
+			require.Equal(t, tc.expectOK, ok)
+		})
+	}
+}